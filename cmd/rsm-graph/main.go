@@ -0,0 +1,28 @@
+// Command rsm-graph builds a small example state machine and dumps its
+// Graphviz DOT representation to stdout, for piping into `dot -Tsvg`:
+//
+//	go run ./cmd/rsm-graph | dot -Tsvg -o graph.svg
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/shuhaowu/rsm"
+)
+
+func retryWaitTime(i int) time.Duration {
+	return time.Second
+}
+
+func main() {
+	sm := rsm.NewRSM("pending", retryWaitTime, 3)
+	sm.AddTransition([]string{"pending"}, "processing", nil)
+	sm.AddTransition([]string{"processing"}, "paid", nil)
+	sm.AddTransition([]string{"processing"}, "failed", nil)
+	sm.AddTransition([]string{"failed"}, "processing", nil)
+
+	if err := sm.ExportDOT(os.Stdout); err != nil {
+		panic(err)
+	}
+}
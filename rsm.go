@@ -1,8 +1,12 @@
 package rsm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -14,32 +18,52 @@ const (
 
 type Event struct {
 	RSM   *RSM
+	Ctx   context.Context
 	Stage int
 	Src   string
 	Dest  string
 	Args  []interface{}
+
+	async bool
+}
+
+// Async marks the in-progress transition as pending on external completion.
+// It must be called from a StageInProgress handler; Transit/TransitContext
+// will then return an *AsyncTransition instead of committing the state
+// change, and the caller resumes it later with Complete or Cancel.
+func (e *Event) Async() {
+	e.async = true
 }
 
-type EventHandler func(*Event) error
+type EventHandler func(ctx context.Context, e *Event) error
 
-func NilHandler(e *Event) error {
+func NilHandler(ctx context.Context, e *Event) error {
 	return nil
 }
 
-// Creates a handler that transitions to another state. Typically called after
-// the transition has taken place (`StageAfter`).
+// TransitionTo returns a handler that chains a follow-up transition to
+// state.
 //
-// Takes a string that's the next state's name and returns an EventHandler.
+// Deprecated: a StageBefore/StageInProgress/StageAfter handler runs while
+// TransitContext still holds the machine's mutex, so calling back into
+// Transit/TransitContext from here would deadlock the goroutine forever.
+// TransitionTo instead queues the follow-up via EnqueueContext, which means
+// it only has an effect once something is running the machine's queue with
+// Run(ctx); without that, the queued transition just sits there.
 //
 // Example:
-//   sm.AddTransition([]string{"start"}, "middle", nil)
-//   sm.AddTransition([]string{"middle"}, "end", nil)
-//   sm.AddAfterHandler([]string{"start"}, "middle", rsm.TransitionTo("end"))
 //
-//   sm.Transit("middle") // will go all the way to the end.
+//	sm.AddTransition([]string{"start"}, "middle", nil)
+//	sm.AddTransition([]string{"middle"}, "end", nil)
+//	sm.AddAfterHandler([]string{"start"}, "middle", rsm.TransitionTo("end"))
+//
+//	go sm.Run(ctx)
+//	sm.Transit("middle") // commits to middle immediately; end is queued
+//	                     // and runs once Run picks it up.
 func TransitionTo(state string) EventHandler {
-	return func(e *Event) error {
-		return e.RSM.Transit(state, e.Args...)
+	return func(ctx context.Context, e *Event) error {
+		e.RSM.EnqueueContext(ctx, state, e.Args...)
+		return nil
 	}
 }
 
@@ -49,12 +73,62 @@ type transitionKey struct {
 	stage      int
 }
 
+type transitionEdge struct {
+	startState string
+	endState   string
+}
+
+// Guard is a predicate evaluated against the (current, next) edge before a
+// transition is allowed to proceed. It returns false, or an error, to reject
+// the transition.
+type Guard func(e *Event) (bool, error)
+
+// GuardRejectedError is returned by Transit/TransitContext when a guard
+// registered with AddGuard rejects the transition, either by returning false
+// or by returning a non-nil error. Guard names the rejecting guard function
+// so callers can tell which business rule fired.
+type GuardRejectedError struct {
+	Src   string
+	Dest  string
+	Guard string
+	Err   error
+}
+
+func (e *GuardRejectedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("guard %s rejected transition from %s to %s: %v", e.Guard, e.Src, e.Dest, e.Err)
+	}
+	return fmt.Sprintf("guard %s rejected transition from %s to %s", e.Guard, e.Src, e.Dest)
+}
+
+func (e *GuardRejectedError) Unwrap() error {
+	return e.Err
+}
+
+func guardName(guard Guard) string {
+	return runtime.FuncForPC(reflect.ValueOf(guard).Pointer()).Name()
+}
+
 type RSM struct {
+	mu sync.Mutex
+
 	transitions        map[transitionKey][]EventHandler
+	guards             map[transitionEdge][]Guard
 	beforeTransition   EventHandler
 	finalizeTransition EventHandler
 	afterTransition    EventHandler
-	quit               chan bool
+	quit               chan struct{}
+	quitOnce           sync.Once
+	pending            *AsyncTransition
+	clock              map[string]uint64
+	stateWaiters       map[string][]chan struct{}
+	leftWaiters        map[string][]chan struct{}
+	queueItems         []*queuedTransition
+	queueHead          int
+	queueSignal        chan struct{}
+	queueMu            sync.Mutex // guards queueItems/queueHead/queueClosed; deliberately not mu, so Enqueue stays callable from a handler that mu is already held for
+	queueClosed        bool
+	substates          map[string]string
 
 	CurrentState  string
 	RetryWaitTime func(int) time.Duration
@@ -62,17 +136,241 @@ type RSM struct {
 	Parent        interface{}
 }
 
+// AsyncTransition is returned, as the error value, by Transit/TransitContext
+// when a StageInProgress handler calls Event.Async() to signal that the
+// state change depends on something external (an RPC, a background job)
+// that hasn't finished yet. It implements error so existing `if err != nil`
+// callers keep working; callers that want to drive the pending transition
+// should type-assert with errors.As and call Complete or Cancel.
+//
+// Until Complete is called, CurrentState stays at the transition's source
+// state, CanTransitionTo refuses any target other than this transition's
+// destination, and StageAfter handlers plus the global afterTransition
+// handler do not run.
+type AsyncTransition struct {
+	Ctx context.Context
+
+	cancel context.CancelFunc
+	rsm    *RSM
+	event  *Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (a *AsyncTransition) Error() string {
+	return fmt.Sprintf("transition from %s to %s is pending completion", a.event.Src, a.event.Dest)
+}
+
+// Done returns a channel that's closed once the pending transition has been
+// resolved with Complete or Cancel.
+func (a *AsyncTransition) Done() <-chan struct{} {
+	return a.done
+}
+
+// Complete commits the pending transition: it runs FinalizeTransitionHandler,
+// moves CurrentState to the destination state, and runs the StageAfter
+// handlers plus the global afterTransition handler, exactly as a synchronous
+// Transit would. It is safe to call more than once; only the first call has
+// an effect, and every call returns that first call's result.
+func (a *AsyncTransition) Complete() error {
+	a.once.Do(func() {
+		defer a.cancel()
+		a.rsm.mu.Lock()
+		defer a.rsm.mu.Unlock()
+		a.rsm.pending = nil
+		a.err = a.rsm.finishTransitionLocked(a.Ctx, a.event)
+		close(a.done)
+	})
+	return a.err
+}
+
+// Cancel abandons the pending transition without ever committing the state
+// change: CurrentState stays at the source state. err is recorded and
+// returned by subsequent calls to Complete or Cancel; if nil, a generic
+// "canceled" error is recorded instead. It is safe to call more than once.
+func (a *AsyncTransition) Cancel(err error) {
+	a.once.Do(func() {
+		defer a.cancel()
+		if err == nil {
+			err = errors.New("async transition canceled")
+		}
+		a.rsm.mu.Lock()
+		a.rsm.pending = nil
+		a.rsm.mu.Unlock()
+		a.err = err
+		close(a.done)
+	})
+}
+
+// beginAsync parks a transition as pending, to be resumed later via the
+// returned AsyncTransition's Complete/Cancel.
+func (r *RSM) beginAsync(ctx context.Context, event *Event) *AsyncTransition {
+	asyncCtx, cancel := context.WithCancel(ctx)
+	async := &AsyncTransition{
+		Ctx:    asyncCtx,
+		cancel: cancel,
+		rsm:    r,
+		event:  event,
+		done:   make(chan struct{}),
+	}
+	r.pending = async
+	return async
+}
+
+// finishTransitionLocked runs the finalize/after portion of a transition:
+// it's shared between the synchronous path in TransitContext and
+// AsyncTransition.Complete. Callers must hold r.mu.
+func (r *RSM) finishTransitionLocked(ctx context.Context, event *Event) error {
+	if r.finalizeTransition != nil {
+		finalizeEvent := &Event{RSM: r, Ctx: ctx, Stage: StageInProgress, Src: event.Src, Dest: event.Dest, Args: event.Args}
+		if err := r.finalizeTransition(ctx, finalizeEvent); err != nil {
+			return err
+		}
+	}
+
+	beforeState := r.CurrentState
+	r.leaveState(beforeState)
+	r.CurrentState = event.Dest
+	r.enterState(r.CurrentState)
+
+	// After transition handlers: the innermost (leaf) state's handler runs
+	// first, out to the outermost ancestor whose subtree was left.
+	if handlers := r.afterHandlersFor(beforeState, r.CurrentState); len(handlers) > 0 {
+		afterEvent := &Event{RSM: r, Ctx: ctx, Stage: StageAfter, Src: beforeState, Dest: r.CurrentState, Args: event.Args}
+		// After transition handler must not return an error.
+		for _, handler := range handlers {
+			handler(ctx, afterEvent)
+		}
+	}
+
+	if r.afterTransition != nil {
+		afterEvent := &Event{RSM: r, Ctx: ctx, Stage: StageAfter, Src: beforeState, Dest: r.CurrentState, Args: event.Args}
+		r.afterTransition(ctx, afterEvent)
+	}
+
+	return nil
+}
+
 func NewRSM(currentState string, retriesWaitTime func(int) time.Duration, maxRetries int) *RSM {
 	rsm := &RSM{}
 	rsm.CurrentState = currentState
 	rsm.RetryWaitTime = retriesWaitTime
 	rsm.MaxRetries = maxRetries
-	rsm.quit = make(chan bool)
+	rsm.quit = make(chan struct{})
 	rsm.transitions = make(map[transitionKey][]EventHandler)
+	rsm.guards = make(map[transitionEdge][]Guard)
+	rsm.clock = make(map[string]uint64)
+	rsm.stateWaiters = make(map[string][]chan struct{})
+	rsm.leftWaiters = make(map[string][]chan struct{})
+	rsm.queueSignal = make(chan struct{}, 1)
+	rsm.substates = make(map[string]string)
+	rsm.enterState(currentState)
 
 	return rsm
 }
 
+// Clock returns a snapshot of the per-state entry counters: clock[s] is the
+// number of times the machine has entered state s, including the initial
+// state set by NewRSM. Comparing two snapshots lets an observer detect that
+// a state was re-entered even if it missed the intermediate exit.
+func (r *RSM) Clock() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clock := make(map[string]uint64, len(r.clock))
+	for state, count := range r.clock {
+		clock[state] = count
+	}
+	return clock
+}
+
+// WhenState returns a channel that's closed the next time the machine enters
+// state. It does not fire if the machine is already in state; register it
+// before triggering the transition you want to observe.
+func (r *RSM) WhenState(state string) <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan struct{})
+	r.stateWaiters[state] = append(r.stateWaiters[state], ch)
+	return ch
+}
+
+// WhenLeft returns a channel that's closed the next time the machine leaves
+// state.
+func (r *RSM) WhenLeft(state string) <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan struct{})
+	r.leftWaiters[state] = append(r.leftWaiters[state], ch)
+	return ch
+}
+
+// WhenDisposed returns a channel that's closed by Stop.
+func (r *RSM) WhenDisposed() <-chan struct{} {
+	return r.quit
+}
+
+// enterState bumps state's clock and wakes up any WhenState waiters for it.
+// Callers must hold r.mu.
+func (r *RSM) enterState(state string) {
+	r.clock[state]++
+	for _, ch := range r.stateWaiters[state] {
+		close(ch)
+	}
+	delete(r.stateWaiters, state)
+}
+
+// leaveState wakes up any WhenLeft waiters for state. Callers must hold r.mu.
+func (r *RSM) leaveState(state string) {
+	for _, ch := range r.leftWaiters[state] {
+		close(ch)
+	}
+	delete(r.leftWaiters, state)
+}
+
+// AddGuard registers a predicate that must pass before the machine is
+// allowed to transition from any of startStates to endState. All guards
+// registered for an edge are evaluated, in registration order, before
+// StageBefore handlers run; the first one to return false or an error fails
+// the transition with a GuardRejectedError.
+func (r *RSM) AddGuard(startStates []string, endState string, guard Guard) {
+	for _, startState := range startStates {
+		edge := transitionEdge{startState, endState}
+		r.guards[edge] = append(r.guards[edge], guard)
+	}
+}
+
+// checkGuards evaluates every guard registered for the (current, next) edge
+// and returns a GuardRejectedError for the first one that rejects the
+// transition, or nil if they all pass. It walks event.Src's ancestor chain
+// the same way nearestOwner does, so a guard declared on a parent edge also
+// protects a transition a descendant inherits from it; guards registered
+// directly on the descendant's own edge take precedence over inherited ones.
+func (r *RSM) checkGuards(event *Event) error {
+	var guards []Guard
+	for _, state := range r.ancestorChain(event.Src) {
+		if g, ok := r.guards[transitionEdge{state, event.Dest}]; ok {
+			guards = g
+			break
+		}
+	}
+
+	for _, guard := range guards {
+		passed, err := guard(event)
+		if err != nil {
+			return &GuardRejectedError{Src: event.Src, Dest: event.Dest, Guard: guardName(guard), Err: err}
+		}
+		if !passed {
+			return &GuardRejectedError{Src: event.Src, Dest: event.Dest, Guard: guardName(guard)}
+		}
+	}
+
+	return nil
+}
+
 func (r *RSM) BeforeTransitionHandler(handler EventHandler) {
 	r.beforeTransition = handler
 }
@@ -118,120 +416,130 @@ func (r *RSM) AddTransition(startStates []string, endState string, handler Event
 }
 
 func (r *RSM) CanTransitionTo(state string) bool {
-	_, ok := r.transitions[transitionKey{r.CurrentState, state, StageInProgress}]
-	return ok
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending != nil {
+		return state == r.pending.event.Dest
+	}
+
+	if _, ok := r.nearestOwner(r.CurrentState, state, StageInProgress); !ok {
+		return false
+	}
+
+	event := &Event{RSM: r, Stage: StageBefore, Src: r.CurrentState, Dest: state}
+	return r.checkGuards(event) == nil
 }
 
+// Transit is equivalent to calling TransitContext with context.Background().
 func (r *RSM) Transit(nextState string, args ...interface{}) error {
-	if !r.CanTransitionTo(nextState) {
+	return r.TransitContext(context.Background(), nextState, args...)
+}
+
+// TransitContext behaves like Transit but threads ctx through to every
+// handler via Event.Ctx, so handlers can observe cancellation or deadlines
+// and propagate them to downstream calls (RPCs, queues, etc).
+//
+// ctx is not checked between handlers automatically: a handler that wants to
+// abort mid-flight must check ctx.Err() itself and return it.
+func (r *RSM) TransitContext(ctx context.Context, nextState string, args ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending != nil {
+		if nextState == r.pending.event.Dest {
+			return r.pending
+		}
+		return errors.New(fmt.Sprintf("Cannot transition from %s to %s: async transition to %s is still pending", r.CurrentState, nextState, r.pending.event.Dest))
+	}
+
+	owner, ok := r.nearestOwner(r.CurrentState, nextState, StageInProgress)
+	if !ok {
 		return errors.New(fmt.Sprintf("Cannot transition from %s to %s", r.CurrentState, nextState))
 	}
 
 	var handlers []EventHandler
-	var ok bool
 	var event *Event
 	var err error
 
+	if err = r.checkGuards(&Event{RSM: r, Ctx: ctx, Stage: StageBefore, Src: r.CurrentState, Dest: nextState, Args: args}); err != nil {
+		return err
+	}
+
 	if r.beforeTransition != nil {
 		event = &Event{
 			RSM:   r,
+			Ctx:   ctx,
 			Stage: StageBefore,
 			Src:   r.CurrentState,
 			Dest:  nextState,
 			Args:  args,
 		}
-		err = r.beforeTransition(event)
+		err = r.beforeTransition(ctx, event)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Before transition handler
-	handlers, ok = r.transitions[transitionKey{r.CurrentState, nextState, StageBefore}]
-
-	if ok {
+	// Before transition handlers: outermost ancestor whose subtree this
+	// transition leaves runs first, down to the current leaf state.
+	handlers = r.beforeHandlersFor(r.CurrentState, nextState)
+	if len(handlers) > 0 {
 		event = &Event{
 			RSM:   r,
+			Ctx:   ctx,
 			Stage: StageBefore,
 			Src:   r.CurrentState,
 			Dest:  nextState,
 			Args:  args,
 		}
 		for _, handler := range handlers {
-			err = handler(event)
+			err = handler(ctx, event)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	// Event transition handler
-	handlers, _ = r.transitions[transitionKey{r.CurrentState, nextState, StageInProgress}]
+	// Event transition handler, taken from whichever ancestor (including
+	// r.CurrentState itself) defines it.
+	handlers = r.transitions[transitionKey{owner, nextState, StageInProgress}]
 	event = &Event{
 		RSM:   r,
+		Ctx:   ctx,
 		Stage: StageInProgress,
 		Src:   r.CurrentState,
 		Dest:  nextState,
 		Args:  args,
 	}
 	for _, handler := range handlers {
-		err = handler(event)
-		if err != nil {
-			return err
-		}
-	}
-
-	if r.finalizeTransition != nil {
-		event = &Event{
-			RSM:   r,
-			Stage: StageInProgress,
-			Src:   r.CurrentState,
-			Dest:  nextState,
-			Args:  args,
-		}
-		err := r.finalizeTransition(event)
+		err = handler(ctx, event)
 		if err != nil {
 			return err
 		}
-	}
-
-	beforeState := r.CurrentState
-	r.CurrentState = nextState
-
-	// After transition handler
-	handlers, ok = r.transitions[transitionKey{beforeState, r.CurrentState, StageAfter}]
-	if ok {
-		event = &Event{
-			RSM:   r,
-			Stage: StageAfter,
-			Src:   beforeState,
-			Dest:  r.CurrentState,
-			Args:  args,
-		}
-		// After transition handler must not return an error.
-		for _, handler := range handlers {
-			handler(event)
+		if event.async {
+			return r.beginAsync(ctx, event)
 		}
 	}
 
-	if r.afterTransition != nil {
-		event = &Event{
-			RSM:   r,
-			Stage: StageAfter,
-			Src:   beforeState,
-			Dest:  r.CurrentState,
-			Args:  args,
-		}
-		r.afterTransition(event)
-	}
-	return nil
+	return r.finishTransitionLocked(ctx, event)
 }
 
 func (r *RSM) maxRetriesReached(nextState string, err error) error {
 	return errors.New(fmt.Sprintf("Error transitioning from %s to %s with error: %v", r.CurrentState, nextState, err))
 }
 
+// TransitWithRetries is equivalent to calling TransitWithRetriesContext with
+// context.Background().
 func (r *RSM) TransitWithRetries(nextState string, args ...interface{}) error {
+	return r.TransitWithRetriesContext(context.Background(), nextState, args...)
+}
+
+// TransitWithRetriesContext behaves like TransitWithRetries but honors ctx
+// cancellation/deadlines in addition to the internal quit channel: the retry
+// loop returns ctx.Err() as soon as ctx.Done() fires, rather than running
+// until MaxRetries is exhausted.
+func (r *RSM) TransitWithRetriesContext(ctx context.Context, nextState string, args ...interface{}) error {
 	var err error
 	i := 1
 
@@ -239,12 +547,14 @@ func (r *RSM) TransitWithRetries(nextState string, args ...interface{}) error {
 		select {
 		case <-r.quit:
 			return err
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-time.After(r.RetryWaitTime(i)):
 			if i > r.MaxRetries {
 				return r.maxRetriesReached(nextState, err)
 			}
 
-			err = r.Transit(nextState, args...)
+			err = r.TransitContext(ctx, nextState, args...)
 			if err == nil {
 				return nil
 			}
@@ -254,6 +564,15 @@ func (r *RSM) TransitWithRetries(nextState string, args ...interface{}) error {
 	}
 }
 
+// Stop signals any in-flight TransitWithRetries loop to abandon retrying and
+// closes the transition queue to new entries, so any Enqueue/EnqueueContext
+// call made after Stop returns is rejected with ErrQueueStopped instead of
+// racing Run's own shutdown drain. It is safe to call Stop more than once.
 func (r *RSM) Stop() {
-	r.quit <- true
+	r.quitOnce.Do(func() {
+		r.queueMu.Lock()
+		r.queueClosed = true
+		r.queueMu.Unlock()
+		close(r.quit)
+	})
 }
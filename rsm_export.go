@@ -0,0 +1,139 @@
+package rsm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// edgeSummary aggregates, for a single (start, end) transition edge, how
+// many handlers are registered at each stage. It exists only to drive the
+// Export* functions below.
+type edgeSummary struct {
+	start, end                string
+	before, inProgress, after int
+}
+
+func (e edgeSummary) label() string {
+	return fmt.Sprintf("before=%d in_progress=%d after=%d", e.before, e.inProgress, e.after)
+}
+
+// edgeSummaries collapses r.transitions, which is keyed per-stage, into one
+// summary per (start, end) edge, sorted by start then end state for
+// deterministic output.
+func (r *RSM) edgeSummaries() []edgeSummary {
+	summaries := make(map[transitionEdge]*edgeSummary)
+
+	for key, handlers := range r.transitions {
+		edge := transitionEdge{key.startState, key.endState}
+		summary, ok := summaries[edge]
+		if !ok {
+			summary = &edgeSummary{start: key.startState, end: key.endState}
+			summaries[edge] = summary
+		}
+
+		switch key.stage {
+		case StageBefore:
+			summary.before = len(handlers)
+		case StageInProgress:
+			summary.inProgress = len(handlers)
+		case StageAfter:
+			summary.after = len(handlers)
+		}
+	}
+
+	sorted := make([]edgeSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		sorted = append(sorted, *summary)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].start != sorted[j].start {
+			return sorted[i].start < sorted[j].start
+		}
+		return sorted[i].end < sorted[j].end
+	})
+
+	return sorted
+}
+
+// states returns every state name that appears in edges, plus extra, sorted
+// and deduplicated.
+func states(edges []edgeSummary, extra ...string) []string {
+	seen := make(map[string]struct{})
+	for _, edge := range edges {
+		seen[edge.start] = struct{}{}
+		seen[edge.end] = struct{}{}
+	}
+	for _, state := range extra {
+		seen[state] = struct{}{}
+	}
+
+	all := make([]string, 0, len(seen))
+	for state := range seen {
+		all = append(all, state)
+	}
+	sort.Strings(all)
+
+	return all
+}
+
+// ExportDOT writes a Graphviz DOT representation of the state machine to w:
+// one node per state, one edge per registered transition labeled with its
+// handler counts, and the current state highlighted. Pipe the output into
+// `dot -Tsvg` to render it.
+func (r *RSM) ExportDOT(w io.Writer) error {
+	r.mu.Lock()
+	edges := r.edgeSummaries()
+	currentState := r.CurrentState
+	r.mu.Unlock()
+
+	if _, err := fmt.Fprintln(w, "digraph rsm {"); err != nil {
+		return err
+	}
+
+	for _, state := range states(edges, currentState) {
+		style := ""
+		if state == currentState {
+			style = ` [style=filled, fillcolor=lightblue]`
+		}
+		if _, err := fmt.Fprintf(w, "  %q%s;\n", state, style); err != nil {
+			return err
+		}
+	}
+
+	for _, edge := range edges {
+		if _, err := fmt.Fprintf(w, "  %q -> %q [label=%q];\n", edge.start, edge.end, edge.label()); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// ExportMermaid writes a Mermaid stateDiagram-v2 representation of the
+// state machine to w, labeling each edge with its handler counts and
+// highlighting the current state via a `current` CSS class.
+func (r *RSM) ExportMermaid(w io.Writer) error {
+	r.mu.Lock()
+	edges := r.edgeSummaries()
+	currentState := r.CurrentState
+	r.mu.Unlock()
+
+	if _, err := fmt.Fprintln(w, "stateDiagram-v2"); err != nil {
+		return err
+	}
+
+	for _, edge := range edges {
+		if _, err := fmt.Fprintf(w, "    %s --> %s: %s\n", edge.start, edge.end, edge.label()); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintln(w, "    classDef current fill:#f96,stroke:#333"); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "    class %s current\n", currentState)
+	return err
+}
@@ -0,0 +1,35 @@
+package rsm
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (r *RSMSuite) TestExportDOT(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddHandler([]string{"start"}, "end", StageAfter, NilHandler)
+
+	var buf bytes.Buffer
+	err := r.rsm.ExportDOT(&buf)
+	c.Assert(err, IsNil)
+
+	out := buf.String()
+	c.Assert(out, Matches, "(?s).*digraph rsm \\{.*")
+	c.Assert(out, Matches, "(?s).*\"start\" -> \"end\".*")
+	c.Assert(out, Matches, "(?s).*in_progress=1 after=1.*")
+	c.Assert(out, Matches, "(?s).*\"start\" \\[style=filled, fillcolor=lightblue\\].*")
+}
+
+func (r *RSMSuite) TestExportMermaid(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+
+	var buf bytes.Buffer
+	err := r.rsm.ExportMermaid(&buf)
+	c.Assert(err, IsNil)
+
+	out := buf.String()
+	c.Assert(out, Matches, "(?s).*stateDiagram-v2.*")
+	c.Assert(out, Matches, "(?s).*start --> end: .*")
+	c.Assert(out, Matches, "(?s).*class start current.*")
+}
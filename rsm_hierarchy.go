@@ -0,0 +1,104 @@
+package rsm
+
+// AddSubstate registers child as a substate (child) of parent: a transition
+// defined on parent is inherited by child and any of child's own
+// descendants, IsIn(parent) reports true while the machine's leaf state is
+// child, and parent's StageBefore/StageAfter handlers wrap around child's
+// own whenever a transition actually leaves parent's subtree.
+//
+// A state may only have one parent; calling AddSubstate again for the same
+// child overwrites its previous parent.
+func (r *RSM) AddSubstate(parent, child string) {
+	r.substates[child] = parent
+}
+
+// IsIn reports whether the machine is currently in state, either as its
+// innermost (leaf) CurrentState or as an ancestor of it registered via
+// AddSubstate.
+func (r *RSM) IsIn(state string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.ancestorChain(r.CurrentState) {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestorChain returns state followed by its ancestors, innermost first,
+// as registered via AddSubstate. A state with no registered parent returns
+// a chain containing just itself.
+func (r *RSM) ancestorChain(state string) []string {
+	chain := []string{state}
+	for {
+		parent, ok := r.substates[state]
+		if !ok {
+			return chain
+		}
+		chain = append(chain, parent)
+		state = parent
+	}
+}
+
+// nearestOwner walks src's ancestor chain, src itself first, and returns the
+// first state that has a stage handler registered for a transition to dest.
+// This is how transitions defined on a parent get inherited by descendants.
+func (r *RSM) nearestOwner(src, dest string, stage int) (string, bool) {
+	for _, state := range r.ancestorChain(src) {
+		if _, ok := r.transitions[transitionKey{state, dest, stage}]; ok {
+			return state, true
+		}
+	}
+	return "", false
+}
+
+// exitedAncestors returns the prefix of src's ancestor chain (src itself
+// first) that a transition to dest actually leaves: every level up to, but
+// not including, the lowest ancestor shared with dest's own chain. A level
+// shared between src and dest is never left, so its handlers don't fire.
+//
+// For a flat machine (no AddSubstate calls), this is just []string{src}
+// when src != dest, matching the pre-hierarchy behavior exactly.
+func (r *RSM) exitedAncestors(src, dest string) []string {
+	shared := make(map[string]struct{})
+	for _, state := range r.ancestorChain(dest) {
+		shared[state] = struct{}{}
+	}
+
+	var exited []string
+	for _, state := range r.ancestorChain(src) {
+		if _, ok := shared[state]; ok {
+			break
+		}
+		exited = append(exited, state)
+	}
+	return exited
+}
+
+// beforeHandlersFor returns every StageBefore handler that should run for a
+// transition from src to dest, outermost exited ancestor first down to the
+// leaf, so a parent's before-handler runs before its descendant's.
+func (r *RSM) beforeHandlersFor(src, dest string) []EventHandler {
+	exited := r.exitedAncestors(src, dest)
+
+	var handlers []EventHandler
+	for i := len(exited) - 1; i >= 0; i-- {
+		handlers = append(handlers, r.transitions[transitionKey{exited[i], dest, StageBefore}]...)
+	}
+	return handlers
+}
+
+// afterHandlersFor mirrors beforeHandlersFor for StageAfter: the leaf's own
+// handler runs first, then its ancestors' out to the outermost one whose
+// subtree the transition left.
+func (r *RSM) afterHandlersFor(src, dest string) []EventHandler {
+	exited := r.exitedAncestors(src, dest)
+
+	var handlers []EventHandler
+	for _, state := range exited {
+		handlers = append(handlers, r.transitions[transitionKey{state, dest, StageAfter}]...)
+	}
+	return handlers
+}
@@ -0,0 +1,88 @@
+package rsm
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+)
+
+func (r *RSMSuite) TestInheritedTransition(c *C) {
+	r.rsm.AddSubstate("running", "running.working")
+	r.rsm.AddSubstate("running", "running.paused")
+	r.rsm.AddTransition([]string{"running"}, "stopped", nil)
+
+	r.rsm.CurrentState = "running.working"
+	c.Assert(r.rsm.CanTransitionTo("stopped"), Equals, true)
+
+	err := r.rsm.Transit("stopped")
+	c.Assert(err, IsNil)
+	c.Assert(r.rsm.CurrentState, Equals, "stopped")
+}
+
+func (r *RSMSuite) TestIsIn(c *C) {
+	r.rsm.AddSubstate("running", "running.working")
+	r.rsm.AddTransition([]string{"start"}, "running.working", nil)
+
+	c.Assert(r.rsm.Transit("running.working"), IsNil)
+	c.Assert(r.rsm.IsIn("running.working"), Equals, true)
+	c.Assert(r.rsm.IsIn("running"), Equals, true)
+	c.Assert(r.rsm.IsIn("start"), Equals, false)
+}
+
+func (r *RSMSuite) TestParentHandlersWrapChildOnlyWhenLeavingSubtree(c *C) {
+	r.rsm.AddSubstate("running", "running.working")
+	r.rsm.AddSubstate("running", "running.paused")
+	r.rsm.AddTransition([]string{"running.working"}, "running.paused", nil)
+	r.rsm.AddTransition([]string{"running.working"}, "stopped", nil)
+	r.rsm.AddTransition([]string{"running"}, "stopped", nil)
+
+	var order []string
+	r.rsm.AddHandler([]string{"running"}, "stopped", StageBefore, func(ctx context.Context, e *Event) error {
+		order = append(order, "parent-before")
+		return nil
+	})
+	r.rsm.AddHandler([]string{"running.working"}, "stopped", StageBefore, func(ctx context.Context, e *Event) error {
+		order = append(order, "child-before")
+		return nil
+	})
+	r.rsm.AddHandler([]string{"running.working"}, "stopped", StageAfter, func(ctx context.Context, e *Event) error {
+		order = append(order, "child-after")
+		return nil
+	})
+	r.rsm.AddHandler([]string{"running"}, "stopped", StageAfter, func(ctx context.Context, e *Event) error {
+		order = append(order, "parent-after")
+		return nil
+	})
+	r.rsm.AddHandler([]string{"running"}, "running.paused", StageBefore, func(ctx context.Context, e *Event) error {
+		order = append(order, "unexpected-parent-before")
+		return nil
+	})
+
+	r.rsm.CurrentState = "running.working"
+	err := r.rsm.Transit("stopped")
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []string{"parent-before", "child-before", "child-after", "parent-after"})
+
+	// A transition that stays within the "running" subtree must not run
+	// running's before/after handlers for this edge.
+	order = nil
+	r.rsm.CurrentState = "running.working"
+	err = r.rsm.Transit("running.paused")
+	c.Assert(err, IsNil)
+	c.Assert(order, IsNil)
+}
+
+func (r *RSMSuite) TestGuardInheritedFromParentEdge(c *C) {
+	r.rsm.AddSubstate("running", "running.working")
+	r.rsm.AddTransition([]string{"running"}, "stopped", nil)
+	r.rsm.AddGuard([]string{"running"}, "stopped", func(e *Event) (bool, error) {
+		return false, nil
+	})
+
+	r.rsm.CurrentState = "running.working"
+	c.Assert(r.rsm.CanTransitionTo("stopped"), Equals, false)
+
+	err := r.rsm.Transit("stopped")
+	c.Assert(err, FitsTypeOf, &GuardRejectedError{})
+	c.Assert(r.rsm.IsIn("running.working"), Equals, true)
+}
@@ -0,0 +1,129 @@
+package rsm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrQueueStopped is sent on the result channel returned by Enqueue for any
+// transition that was queued but never ran because the machine stopped
+// first.
+var ErrQueueStopped = errors.New("rsm: enqueued transition not run, machine stopped")
+
+// queuedTransition is one FIFO entry: the transition to run and where to
+// deliver its result.
+type queuedTransition struct {
+	ctx       context.Context
+	nextState string
+	args      []interface{}
+	result    chan error
+}
+
+// Enqueue is equivalent to calling EnqueueContext with context.Background().
+func (r *RSM) Enqueue(nextState string, args ...interface{}) <-chan error {
+	return r.EnqueueContext(context.Background(), nextState, args...)
+}
+
+// EnqueueContext pushes a transition onto the machine's internal FIFO queue,
+// to be run by Run one at a time, and returns a channel that receives that
+// transition's result once it runs. The queue is unbounded, so this never
+// blocks: it's the safe way for a StageInProgress handler to chain a
+// follow-up transition, since calling e.RSM.Enqueue(...) only ever takes the
+// dedicated queue lock rather than recursing into Transit/TransitContext
+// (which would deadlock against the mutex the in-flight transition is still
+// holding) or blocking on Run draining a bounded buffer (which would wedge
+// the machine if Run is itself stuck inside that same in-flight transition).
+func (r *RSM) EnqueueContext(ctx context.Context, nextState string, args ...interface{}) <-chan error {
+	result := make(chan error, 1)
+	req := &queuedTransition{ctx: ctx, nextState: nextState, args: args, result: result}
+
+	r.queueMu.Lock()
+	if r.queueClosed {
+		r.queueMu.Unlock()
+		result <- ErrQueueStopped
+		return result
+	}
+	r.queueItems = append(r.queueItems, req)
+	r.queueMu.Unlock()
+
+	select {
+	case r.queueSignal <- struct{}{}:
+	default:
+	}
+
+	return result
+}
+
+// Run drains the machine's transition queue, running one transition at a
+// time via TransitContext, until ctx is done or Stop is called. When it
+// stops, any transition still sitting in the queue, or pushed after, is
+// rejected with ErrQueueStopped rather than silently dropped. Run is meant
+// to be started in its own goroutine, e.g. `go sm.Run(ctx)`.
+func (r *RSM) Run(ctx context.Context) {
+	for {
+		select {
+		case <-r.quit:
+			r.stopQueue()
+			return
+		case <-ctx.Done():
+			r.stopQueue()
+			return
+		default:
+		}
+
+		req, ok := r.popQueue()
+		if !ok {
+			select {
+			case <-r.quit:
+				r.stopQueue()
+				return
+			case <-ctx.Done():
+				r.stopQueue()
+				return
+			case <-r.queueSignal:
+			}
+			continue
+		}
+
+		req.result <- r.TransitContext(req.ctx, req.nextState, req.args...)
+	}
+}
+
+// popQueue removes and returns the oldest queued transition, if any. It
+// advances queueHead rather than reslicing from the front, so a steady
+// one-in-one-out workload doesn't reallocate queueItems on every call; once
+// the queue is fully drained, the backing array is reset and reused.
+func (r *RSM) popQueue() (*queuedTransition, bool) {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+
+	if r.queueHead == len(r.queueItems) {
+		return nil, false
+	}
+
+	req := r.queueItems[r.queueHead]
+	r.queueItems[r.queueHead] = nil
+	r.queueHead++
+	if r.queueHead == len(r.queueItems) {
+		r.queueItems = r.queueItems[:0]
+		r.queueHead = 0
+	}
+	return req, true
+}
+
+// stopQueue closes the queue to new entries and rejects whatever is left in
+// it. Because EnqueueContext never blocks waiting for Run, this always
+// terminates promptly on either shutdown route (Stop or ctx cancellation),
+// with nothing left stranded.
+func (r *RSM) stopQueue() {
+	r.queueMu.Lock()
+	r.queueClosed = true
+	items := r.queueItems[r.queueHead:]
+	r.queueItems = nil
+	r.queueHead = 0
+	r.queueMu.Unlock()
+
+	for _, req := range items {
+		req.result <- ErrQueueStopped
+	}
+}
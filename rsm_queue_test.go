@@ -0,0 +1,155 @@
+package rsm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (r *RSMSuite) TestEnqueueProcessedByRun(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.rsm.Run(ctx)
+
+	result := r.rsm.Enqueue("end")
+
+	select {
+	case err := <-result:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("enqueued transition never ran")
+	}
+
+	c.Assert(r.rsm.CurrentState, Equals, "end")
+}
+
+func (r *RSMSuite) TestEnqueueChainedFromInProgressHandler(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "middle", func(ctx context.Context, e *Event) error {
+		e.RSM.Enqueue("end")
+		return nil
+	})
+	r.rsm.AddTransition([]string{"middle"}, "end", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.rsm.Run(ctx)
+
+	reachedEnd := r.rsm.WhenState("end")
+	result := r.rsm.Enqueue("middle")
+
+	select {
+	case err := <-result:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("enqueued transition never ran")
+	}
+
+	select {
+	case <-reachedEnd:
+	case <-time.After(time.Second):
+		c.Fatal("chained transition never reached end")
+	}
+	c.Assert(r.rsm.IsIn("end"), Equals, true)
+}
+
+func (r *RSMSuite) TestEnqueueRejectedAfterStop(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.Stop()
+
+	result := r.rsm.Enqueue("end")
+	select {
+	case err := <-result:
+		c.Assert(err, Equals, ErrQueueStopped)
+	case <-time.After(time.Second):
+		c.Fatal("enqueue should have been rejected immediately")
+	}
+}
+
+// TestRunDrainsQueueOnContextCancelWhileBusy guards against a goroutine leak:
+// if ctx is canceled while Run is stuck inside a long-running transition and
+// a large backlog has piled up behind it, every backlogged item must still
+// be resolved once Run comes back around to check ctx.Done(), not just the
+// ones that would have fit in the old bounded queue.
+func (r *RSMSuite) TestRunDrainsQueueOnContextCancelWhileBusy(c *C) {
+	started := make(chan struct{})
+	resume := make(chan struct{})
+	r.rsm.AddTransition([]string{"start"}, "working", func(ctx context.Context, e *Event) error {
+		close(started)
+		<-resume
+		return nil
+	})
+	r.rsm.AddTransition([]string{"working"}, "end", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.rsm.Run(ctx)
+
+	busy := r.rsm.Enqueue("working")
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		c.Fatal("busy transition never started")
+	}
+
+	// Pile up a backlog far past the old bounded queue's capacity while Run
+	// is unable to drain it, being stuck inside TransitContext.
+	const n = 200
+	results := make([]<-chan error, n)
+	for i := range results {
+		results[i] = r.rsm.Enqueue("end")
+	}
+
+	cancel()
+	close(resume)
+
+	select {
+	case err := <-busy:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("busy transition never finished")
+	}
+
+	for _, result := range results {
+		select {
+		case err := <-result:
+			c.Assert(err, Equals, ErrQueueStopped)
+		case <-time.After(time.Second):
+			c.Fatal("queued transition left stranded after context cancel")
+		}
+	}
+}
+
+// TestEnqueueRacingStopGetsAResult guards against a lost-item race: Stop
+// closing the queue concurrently with an in-flight Enqueue call must not
+// leave that call's result channel empty, whichever side wins the race.
+func (r *RSMSuite) TestEnqueueRacingStopGetsAResult(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.rsm.Run(ctx)
+
+	var wg sync.WaitGroup
+	results := make([]<-chan error, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.rsm.Enqueue("end")
+		}(i)
+	}
+	wg.Wait()
+	r.rsm.Stop()
+
+	for _, result := range results {
+		select {
+		case <-result:
+		case <-time.After(time.Second):
+			c.Fatal("an enqueued transition was never resolved after Stop")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package rsm
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -30,7 +31,7 @@ func (r *RSMSuite) TestStateTranstionBefore(c *C) {
 	args := []string{"1", "2"}
 	handlerCalled := false
 
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		handlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -46,8 +47,8 @@ func (r *RSMSuite) TestStateTranstionBefore(c *C) {
 		return nil
 	}
 
-	r.rsm.AddTransition("start", "end", nil)
-	r.rsm.AddHandler("start", "end", StageBefore, handler)
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddHandler([]string{"start"}, "end", StageBefore, handler)
 
 	err := r.rsm.Transit("end", "1", "2")
 	c.Assert(err, IsNil)
@@ -59,7 +60,7 @@ func (r *RSMSuite) TestStateTransitionInProgress(c *C) {
 	args := []string{"1", "2"}
 	handlerCalled := false
 
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		handlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -75,7 +76,7 @@ func (r *RSMSuite) TestStateTransitionInProgress(c *C) {
 		return nil
 	}
 
-	r.rsm.AddTransition("start", "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
 
 	err := r.rsm.Transit("end", "1", "2")
 	c.Assert(err, IsNil)
@@ -87,7 +88,7 @@ func (r *RSMSuite) TestStateTransitionAfter(c *C) {
 	args := []string{"1", "2"}
 	handlerCalled := false
 
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		handlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -103,8 +104,8 @@ func (r *RSMSuite) TestStateTransitionAfter(c *C) {
 		return nil
 	}
 
-	r.rsm.AddTransition("start", "end", nil)
-	r.rsm.AddHandler("start", "end", StageAfter, handler)
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddHandler([]string{"start"}, "end", StageAfter, handler)
 
 	err := r.rsm.Transit("end", "1", "2")
 	c.Assert(err, IsNil)
@@ -113,12 +114,12 @@ func (r *RSMSuite) TestStateTransitionAfter(c *C) {
 }
 
 func (r *RSMSuite) TestStateTransitionFailDuringBefore(c *C) {
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		return r.err
 	}
 
-	r.rsm.AddTransition("start", "end", nil)
-	r.rsm.AddHandler("start", "end", StageBefore, handler)
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddHandler([]string{"start"}, "end", StageBefore, handler)
 
 	err := r.rsm.Transit("end")
 	c.Assert(err, Equals, r.err)
@@ -126,11 +127,11 @@ func (r *RSMSuite) TestStateTransitionFailDuringBefore(c *C) {
 }
 
 func (r *RSMSuite) TestStateTransitionFailDuringInProgress(c *C) {
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		return r.err
 	}
 
-	r.rsm.AddTransition("start", "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
 
 	err := r.rsm.Transit("end")
 	c.Assert(err, Equals, r.err)
@@ -142,7 +143,7 @@ func (r *RSMSuite) TestBeforeAfterFinalizeAllTransitionsHandler(c *C) {
 	beforeHandlerCalled := false
 	finalizeHandlerCalled := false
 	afterHandlerCalled := false
-	beforeHandler := func(e *Event) error {
+	beforeHandler := func(ctx context.Context, e *Event) error {
 		beforeHandlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -158,7 +159,7 @@ func (r *RSMSuite) TestBeforeAfterFinalizeAllTransitionsHandler(c *C) {
 		return nil
 	}
 
-	finalizeHandler := func(e *Event) error {
+	finalizeHandler := func(ctx context.Context, e *Event) error {
 		finalizeHandlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -174,7 +175,7 @@ func (r *RSMSuite) TestBeforeAfterFinalizeAllTransitionsHandler(c *C) {
 		return nil
 	}
 
-	afterHandler := func(e *Event) error {
+	afterHandler := func(ctx context.Context, e *Event) error {
 		afterHandlerCalled = true
 		eargs := make([]string, len(e.Args))
 		for i, a := range e.Args {
@@ -193,7 +194,7 @@ func (r *RSMSuite) TestBeforeAfterFinalizeAllTransitionsHandler(c *C) {
 	r.rsm.BeforeTransitionHandler(beforeHandler)
 	r.rsm.FinalizeTransitionHandler(finalizeHandler)
 	r.rsm.AfterTransitionHandler(afterHandler)
-	r.rsm.AddTransition("start", "end", nil)
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
 
 	err := r.rsm.Transit("end", "1", "2")
 	c.Assert(err, IsNil)
@@ -205,17 +206,17 @@ func (r *RSMSuite) TestBeforeAfterFinalizeAllTransitionsHandler(c *C) {
 
 func (r *RSMSuite) TestMultipleHandlers(c *C) {
 	counter := 0
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		counter++
 		return nil
 	}
 
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
 	err := r.rsm.Transit("end")
 	c.Assert(err, IsNil)
 	c.Assert(counter, Equals, 6)
@@ -223,19 +224,19 @@ func (r *RSMSuite) TestMultipleHandlers(c *C) {
 
 func (r *RSMSuite) TestMultipleHandlersFailAny(c *C) {
 	successCalled := 0
-	handler := func(e *Event) error {
+	handler := func(ctx context.Context, e *Event) error {
 		successCalled++
 		return nil
 	}
 
-	failHandler := func(e *Event) error {
+	failHandler := func(ctx context.Context, e *Event) error {
 		return r.err
 	}
 
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", handler)
-	r.rsm.AddTransition("start", "end", failHandler)
-	r.rsm.AddTransition("start", "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
+	r.rsm.AddTransition([]string{"start"}, "end", failHandler)
+	r.rsm.AddTransition([]string{"start"}, "end", handler)
 
 	err := r.rsm.Transit("end")
 	c.Assert(err, Equals, r.err)
@@ -249,47 +250,47 @@ func (r *RSMSuite) TestTransitionToNonExistentState(c *C) {
 
 func (r *RSMSuite) TestHandlerOrders(c *C) {
 	stage := 0
-	beforeAllHandler := func(e *Event) error {
+	beforeAllHandler := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 0)
 		stage = 1
 		return nil
 	}
 
-	beforeTransitionHandler := func(e *Event) error {
+	beforeTransitionHandler := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 1)
 		stage = 2
 		return nil
 	}
 
-	inProgressHandler1 := func(e *Event) error {
+	inProgressHandler1 := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 2)
 		stage = 3
 		return nil
 	}
 
-	inProgressHandler2 := func(e *Event) error {
+	inProgressHandler2 := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 3)
 		stage = 4
 		return nil
 	}
 
-	afterTransitionHandler := func(e *Event) error {
+	afterTransitionHandler := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 4)
 		stage = 5
 		return nil
 	}
 
-	afterAllHandler := func(e *Event) error {
+	afterAllHandler := func(ctx context.Context, e *Event) error {
 		c.Assert(stage, Equals, 5)
 		stage = 6
 		return nil
 	}
 
 	r.rsm.BeforeTransitionHandler(beforeAllHandler)
-	r.rsm.AddHandler("start", "end", StageBefore, beforeTransitionHandler)
-	r.rsm.AddTransition("start", "end", inProgressHandler1)
-	r.rsm.AddTransition("start", "end", inProgressHandler2)
-	r.rsm.AddHandler("start", "end", StageAfter, afterTransitionHandler)
+	r.rsm.AddHandler([]string{"start"}, "end", StageBefore, beforeTransitionHandler)
+	r.rsm.AddTransition([]string{"start"}, "end", inProgressHandler1)
+	r.rsm.AddTransition([]string{"start"}, "end", inProgressHandler2)
+	r.rsm.AddHandler([]string{"start"}, "end", StageAfter, afterTransitionHandler)
 	r.rsm.AfterTransitionHandler(afterAllHandler)
 
 	r.rsm.Transit("end")
@@ -297,12 +298,12 @@ func (r *RSMSuite) TestHandlerOrders(c *C) {
 }
 
 func (r *RSMSuite) TestStateTransitionRetries(c *C) {
-	failHandler := func(e *Event) error {
+	failHandler := func(ctx context.Context, e *Event) error {
 		return r.err
 	}
 
 	i := 0
-	successAfter3 := func(e *Event) error {
+	successAfter3 := func(ctx context.Context, e *Event) error {
 		i++
 		if i < 3 {
 			return r.err
@@ -310,9 +311,9 @@ func (r *RSMSuite) TestStateTransitionRetries(c *C) {
 		return nil
 	}
 
-	r.rsm.AddTransition("start", "fail", failHandler)
-	r.rsm.AddTransition("start", "end", nil)
-	r.rsm.AddHandler("start", "end", StageBefore, successAfter3)
+	r.rsm.AddTransition([]string{"start"}, "fail", failHandler)
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddHandler([]string{"start"}, "end", StageBefore, successAfter3)
 
 	err := r.rsm.TransitWithRetries("fail")
 	c.Assert(err, NotNil)
@@ -323,3 +324,192 @@ func (r *RSMSuite) TestStateTransitionRetries(c *C) {
 	c.Assert(i, Equals, 3)
 	c.Assert(r.rsm.CurrentState, Equals, "end")
 }
+
+func rejectingGuard(e *Event) (bool, error) {
+	return false, nil
+}
+
+func (r *RSMSuite) TestGuardRejectsTransition(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddGuard([]string{"start"}, "end", rejectingGuard)
+
+	c.Assert(r.rsm.CanTransitionTo("end"), Equals, false)
+
+	err := r.rsm.Transit("end")
+	c.Assert(err, NotNil)
+
+	rejected, ok := err.(*GuardRejectedError)
+	c.Assert(ok, Equals, true)
+	c.Assert(rejected.Guard, Matches, ".*rejectingGuard")
+	c.Assert(r.rsm.CurrentState, Equals, "start")
+}
+
+func (r *RSMSuite) TestGuardErrorRejectsTransition(c *C) {
+	guardErr := errors.New("invoice total must be positive")
+	guard := func(e *Event) (bool, error) {
+		return false, guardErr
+	}
+
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddGuard([]string{"start"}, "end", guard)
+
+	err := r.rsm.Transit("end")
+	rejected, ok := err.(*GuardRejectedError)
+	c.Assert(ok, Equals, true)
+	c.Assert(rejected.Err, Equals, guardErr)
+}
+
+func (r *RSMSuite) TestAsyncTransitionDefersStateChange(c *C) {
+	afterCalled := false
+	r.rsm.AddTransition([]string{"start"}, "end", func(ctx context.Context, e *Event) error {
+		e.Async()
+		return nil
+	})
+	r.rsm.AddHandler([]string{"start"}, "end", StageAfter, func(ctx context.Context, e *Event) error {
+		afterCalled = true
+		return nil
+	})
+
+	err := r.rsm.Transit("end")
+	async, ok := err.(*AsyncTransition)
+	c.Assert(ok, Equals, true)
+	c.Assert(r.rsm.CurrentState, Equals, "start")
+	c.Assert(afterCalled, Equals, false)
+
+	select {
+	case <-async.Done():
+		c.Fatal("async transition should not be done yet")
+	default:
+	}
+
+	c.Assert(r.rsm.CanTransitionTo("other"), Equals, false)
+	c.Assert(r.rsm.CanTransitionTo("end"), Equals, true)
+
+	c.Assert(async.Complete(), IsNil)
+	c.Assert(r.rsm.CurrentState, Equals, "end")
+	c.Assert(afterCalled, Equals, true)
+
+	select {
+	case <-async.Done():
+	default:
+		c.Fatal("async transition should be done after Complete")
+	}
+}
+
+func (r *RSMSuite) TestAsyncTransitionCancel(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", func(ctx context.Context, e *Event) error {
+		e.Async()
+		return nil
+	})
+
+	err := r.rsm.Transit("end")
+	async := err.(*AsyncTransition)
+
+	cancelErr := errors.New("job failed")
+	async.Cancel(cancelErr)
+	c.Assert(r.rsm.CurrentState, Equals, "start")
+
+	err = r.rsm.Transit("end")
+	async, ok := err.(*AsyncTransition)
+	c.Assert(ok, Equals, true)
+	c.Assert(async.Complete(), IsNil)
+	c.Assert(r.rsm.CurrentState, Equals, "end")
+}
+
+func (r *RSMSuite) TestClockIncrementsOnEntry(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddTransition([]string{"end"}, "start", nil)
+
+	c.Assert(r.rsm.Clock()["start"], Equals, uint64(1))
+	c.Assert(r.rsm.Clock()["end"], Equals, uint64(0))
+
+	c.Assert(r.rsm.Transit("end"), IsNil)
+	c.Assert(r.rsm.Clock()["end"], Equals, uint64(1))
+
+	c.Assert(r.rsm.Transit("start"), IsNil)
+	c.Assert(r.rsm.Clock()["start"], Equals, uint64(2))
+}
+
+func (r *RSMSuite) TestWhenStateAndWhenLeft(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+
+	entered := r.rsm.WhenState("end")
+	left := r.rsm.WhenLeft("start")
+
+	select {
+	case <-entered:
+		c.Fatal("should not have entered end yet")
+	case <-left:
+		c.Fatal("should not have left start yet")
+	default:
+	}
+
+	c.Assert(r.rsm.Transit("end"), IsNil)
+
+	select {
+	case <-entered:
+	default:
+		c.Fatal("should have entered end")
+	}
+
+	select {
+	case <-left:
+	default:
+		c.Fatal("should have left start")
+	}
+}
+
+func (r *RSMSuite) TestWhenDisposed(c *C) {
+	disposed := r.rsm.WhenDisposed()
+
+	select {
+	case <-disposed:
+		c.Fatal("should not be disposed yet")
+	default:
+	}
+
+	r.rsm.Stop()
+
+	select {
+	case <-disposed:
+	default:
+		c.Fatal("should be disposed after Stop")
+	}
+}
+
+func (r *RSMSuite) TestGuardPassesTransition(c *C) {
+	passingGuard := func(e *Event) (bool, error) {
+		return true, nil
+	}
+
+	r.rsm.AddTransition([]string{"start"}, "end", nil)
+	r.rsm.AddGuard([]string{"start"}, "end", passingGuard)
+
+	c.Assert(r.rsm.CanTransitionTo("end"), Equals, true)
+
+	err := r.rsm.Transit("end")
+	c.Assert(err, IsNil)
+	c.Assert(r.rsm.CurrentState, Equals, "end")
+}
+
+func (r *RSMSuite) TestTransitionToChainsViaQueue(c *C) {
+	r.rsm.AddTransition([]string{"start"}, "middle", nil)
+	r.rsm.AddTransition([]string{"middle"}, "end", nil)
+	r.rsm.AddAfterHandler([]string{"start"}, "middle", TransitionTo("end"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.rsm.Run(ctx)
+
+	reachedEnd := r.rsm.WhenState("end")
+
+	err := r.rsm.Transit("middle")
+	c.Assert(err, IsNil)
+
+	select {
+	case <-reachedEnd:
+	case <-time.After(time.Second):
+		c.Fatal("TransitionTo's queued transition never ran")
+	}
+	c.Assert(r.rsm.IsIn("end"), Equals, true)
+}